@@ -0,0 +1,151 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Command overlord starts an Overlord server, or generates a deployment
+// bundle for one. It follows the "generate vs run" split used by Psiphon's
+// server binary: `overlord generate` writes everything a fresh deployment
+// needs to disk, and `overlord run` loads and validates that bundle before
+// binding any sockets.
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"overlord"
+)
+
+type stringList []string
+
+func (self *stringList) String() string { return fmt.Sprint(*self) }
+func (self *stringList) Set(v string) error {
+	*self = append(*self, v)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "generate":
+		runGenerate(os.Args[2:])
+	case "run":
+		runRun(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: overlord <generate|run> [flags]")
+}
+
+func runGenerate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	dir := fs.String("dir", "./overlord-bundle", "directory to write the deployment bundle to")
+	ipaddress := fs.String("ipaddress", "", "public IP address or hostname ghosts should dial")
+	port := fs.Int("port", 4455, "RPC port (equivalent of Psiphon's -osshport for our transport)")
+	httpPort := fs.Int("http-port", 9000, "HTTP port for the dashboard and file transfer endpoints")
+	sshPortStart := fs.Int("target-ssh-port-start", 9100, "start of the TARGET_SSH_PORT range")
+	sshPortEnd := fs.Int("target-ssh-port-end", 9200, "end of the TARGET_SSH_PORT range")
+	adminUser := fs.String("admin-user", "admin", "dashboard admin username")
+	adminPassword := fs.String("admin-password", "", "dashboard admin password (required)")
+	fs.Parse(args)
+
+	if *adminPassword == "" {
+		log.Fatal("generate: -admin-password is required")
+	}
+
+	opts := overlord.GenerateOptions{
+		IPAddress:         *ipaddress,
+		RPCPort:           *port,
+		HTTPPort:          *httpPort,
+		TargetSSHPortLow:  *sshPortStart,
+		TargetSSHPortHigh: *sshPortEnd,
+		AdminUser:         *adminUser,
+		AdminPassword:     *adminPassword,
+	}
+
+	if err := overlord.GenerateBundle(*dir, opts); err != nil {
+		log.Fatalf("generate: %s", err)
+	}
+	fmt.Printf("Deployment bundle written to %s\n", *dir)
+}
+
+func runRun(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	var configPaths stringList
+	fs.Var(&configPaths, "config", "path to a bundle config file; may be repeated to merge multiple files")
+	importCACert := fs.String("import-ca-cert", "", "replace the managed CA with an externally supplied cert (requires -import-ca-key)")
+	importCAKey := fs.String("import-ca-key", "", "private key matching -import-ca-cert")
+	rotateServerKey := fs.Bool("rotate-server-key", false, "re-issue the server cert/key pair under the existing CA and exit")
+	bootstrapTokenFor := fs.String("bootstrap-token-for", "", "print a one-time bootstrap token a ghost with this machine ID can redeem for a client cert, then exit")
+	fs.Parse(args)
+
+	cfg, err := overlord.LoadConfigs(configPaths)
+	if err != nil {
+		log.Fatalf("run: %s", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("run: invalid configuration: %s", err)
+	}
+
+	if *importCACert != "" || *importCAKey != "" || *rotateServerKey || *bootstrapTokenFor != "" {
+		certMgr, err := overlord.NewCertManager(cfg.TLSStateDir)
+		if err != nil {
+			log.Fatalf("run: %s", err)
+		}
+
+		if *importCACert != "" || *importCAKey != "" {
+			if *importCACert == "" || *importCAKey == "" {
+				log.Fatal("run: -import-ca-cert and -import-ca-key must be given together")
+			}
+			if err := certMgr.ImportCA(*importCACert, *importCAKey); err != nil {
+				log.Fatalf("run: %s", err)
+			}
+			fmt.Println("Imported external CA and re-issued the server cert")
+		}
+
+		if *rotateServerKey {
+			if err := certMgr.RotateServerKey(); err != nil {
+				log.Fatalf("run: %s", err)
+			}
+			fmt.Println("Rotated server cert/key")
+		}
+
+		if *bootstrapTokenFor != "" {
+			token, err := certMgr.IssueBootstrapToken(*bootstrapTokenFor)
+			if err != nil {
+				log.Fatalf("run: %s", err)
+			}
+			fmt.Printf("Bootstrap token for %s: %s\n", *bootstrapTokenFor, token)
+		}
+		return
+	}
+
+	var signingPubKey ed25519.PublicKey
+	if cfg.SigningPubKeyPath != "" {
+		signingPubKey, err = overlord.LoadSigningPubKey(cfg.SigningPubKeyPath)
+		if err != nil {
+			log.Fatalf("run: %s", err)
+		}
+	}
+
+	log.Printf("Starting Overlord on %s (rpc=%d, http=%d)\n", cfg.ListenAddr, cfg.RPCPort, cfg.HTTPPort)
+	// Overlord's own constructor and socket binding live in overlord.go,
+	// which this repo snapshot doesn't include; once that file exists, its
+	// listener should be wrapped with a *CertManager's WrapListener so every
+	// accepted ghost connection presents and requires mTLS before reaching
+	// ConnServer, and signingPubKey above should be threaded into its
+	// constructor so handleRegisterRequest can verify a ghost's
+	// SignedServerEntry instead of leaving signingPubKey nil.
+	_ = signingPubKey
+}
@@ -23,6 +23,32 @@ const (
 	PING_RECV_TIMEOUT = PING_TIMEOUT * 2
 )
 
+// Session is the transport-agnostic view of a ghost connection that
+// Overlord.Register operates on. ConnServer (custom JSON-RPC framing) is
+// the only implementation today; the interface exists so a second
+// transport could land in the same session bookkeeping without
+// Overlord.Register or anything downstream of it having to know which one
+// a given ghost picked.
+type Session interface {
+	GetMode() int
+	GetSid() string
+	GetMid() string
+	GetProperties() map[string]interface{}
+	GetTargetSSHPort() int
+	SetTargetSSHPort(port int)
+
+	CommandChan() chan<- interface{}
+	Terminate()
+}
+
+func (self *ConnServer) GetMode() int                          { return self.Mode }
+func (self *ConnServer) GetSid() string                        { return self.Sid }
+func (self *ConnServer) GetMid() string                        { return self.Mid }
+func (self *ConnServer) GetProperties() map[string]interface{} { return self.Properties }
+func (self *ConnServer) GetTargetSSHPort() int                 { return self.TargetSSHPort }
+func (self *ConnServer) SetTargetSSHPort(port int)             { self.TargetSSHPort = port }
+func (self *ConnServer) CommandChan() chan<- interface{}       { return self.Command }
+
 type TerminalControl struct {
 	Type string `json:"type"`
 	Data string `json:"data"`
@@ -31,14 +57,22 @@ type TerminalControl struct {
 type LogcatContext struct {
 	Format  int               // Log format, see constants.go
 	WsConns []*websocket.Conn // WebSockets for logcat
-	History string            // Log buffer for logcat
 }
 
 type FileDownloadContext struct {
-	Name  string      // Download filename
-	Size  int64       // Download filesize
-	Data  chan []byte // Channel for download data
-	Ready bool        // Ready for download
+	Name string // Download filename
+	Size int64  // Download filesize
+	// Offset is set from request_to_download/clear_to_upload's resume_from
+	// and from handleRetryChunkRequest, each time recording where the next
+	// chunk the ghost sends (or should resend) is expected to start. The
+	// code that actually seeks/resumes a transfer using this value is part
+	// of Overlord's download/upload driving loop, which isn't in this
+	// snapshot — Chunks.Send/file_http.go's HandleFileDownload don't read
+	// it, they just forward whatever arrives until EOF.
+	Offset int64
+	Chunks *ChunkPool      // Chunk pool for backpressured download data
+	parser fileFrameParser // Reassembles FileChunks split across Listen() reads
+	Ready  bool            // Ready for download
 }
 
 // Since Shell and Logcat are initiated by Overlord, there is only one observer,
@@ -74,7 +108,6 @@ func NewConnServer(ovl *Overlord, conn net.Conn) *ConnServer {
 		ovl:        ovl,
 		stopListen: make(chan bool, 1),
 		registered: false,
-		Download:   FileDownloadContext{Data: make(chan []byte)},
 	}
 }
 
@@ -103,6 +136,9 @@ func (self *ConnServer) Terminate() {
 		self.wsConn.WriteMessage(websocket.CloseMessage, []byte(""))
 		self.wsConn.Close()
 	}
+	if self.Download.Chunks != nil {
+		self.Download.Chunks.Close()
+	}
 }
 
 // writeWebsocket is a helper function for written text to websocket in the
@@ -164,11 +200,13 @@ func (self *ConnServer) forwardShellOutput(buffer string) {
 	self.writeLogToWS(self.wsConn, buffer)
 }
 
-// Forward the logcat output to WebSocket.
+// Forward the logcat output to WebSocket, writing it through to the
+// on-disk, compressed history kept by self.ovl.logcatStore so a late-joining
+// browser can still replay it (see handleOverlordRequest's ConnectLogcatCmd
+// case) instead of only ever seeing the last LOG_BUFSIZ bytes kept in RAM.
 func (self *ConnServer) forwardLogcatOutput(buffer string) {
-	self.logcat.History += buffer
-	if l := len(self.logcat.History); l > LOG_BUFSIZ {
-		self.logcat.History = self.logcat.History[l-LOG_BUFSIZ : l]
+	if err := self.ovl.logcatStore.Append(self.Mid, self.Sid, []byte(buffer)); err != nil {
+		log.Printf("logcat store: failed to append for %s/%s: %s\n", self.Mid, self.Sid, err)
 	}
 
 	var aliveWsConns []*websocket.Conn
@@ -182,8 +220,36 @@ func (self *ConnServer) forwardLogcatOutput(buffer string) {
 	self.logcat.WsConns = aliveWsConns
 }
 
-func (self *ConnServer) forwardFileDownloadData(buffer []byte) {
-	self.Download.Data <- buffer
+// forwardFileDownloadData reassembles framed chunks out of buffer (which may
+// contain a partial frame, several frames, or both) and hands each complete
+// one to the download's ChunkPool. Chunks that fail their CRC32C are not
+// forwarded; instead we ask the ghost to resend them with retry_chunk,
+// rather than passing corrupt data on to the HTTP client. It returns an
+// error if the ghost sent a frame violating the wire framing (e.g. an
+// oversized length), which the caller treats as fatal for the connection.
+func (self *ConnServer) forwardFileDownloadData(buffer []byte) error {
+	chunks, err := self.Download.parser.Feed(buffer)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if !chunk.VerifyCRC() {
+			log.Printf("download %s: CRC mismatch at offset %d, requesting retry\n", self.Download.Name, chunk.Offset)
+			self.RequestChunkRetry(chunk.Offset)
+			continue
+		}
+		if !self.Download.Chunks.Send(chunk.Offset, chunk.Data, chunk.EOF) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// RequestChunkRetry asks the ghost to resend the chunk starting at offset,
+// used both after a CRC32C mismatch and to resume an interrupted transfer.
+func (self *ConnServer) RequestChunkRetry(offset int64) {
+	req := NewRequest("retry_chunk", map[string]interface{}{"offset": offset})
+	self.SendRequest(req, self.getHandler("RequestChunkRetry"))
 }
 
 func (self *ConnServer) ProcessRequests(reqs []*Request) error {
@@ -204,8 +270,14 @@ func (self *ConnServer) handleOverlordRequest(obj interface{}) {
 	case SpawnShellCmd:
 		self.SpawnShell(v.Sid, v.Command)
 	case ConnectLogcatCmd:
-		// Write log history to newly joined client
-		self.writeLogToWS(v.Conn, self.logcat.History)
+		// Replay the tail of the on-disk history to the newly joined client
+		// before it starts receiving live output.
+		tail, err := self.ovl.logcatStore.Tail(self.Mid, self.Sid, LOGCAT_TAIL_BYTES)
+		if err != nil {
+			log.Printf("logcat store: failed to read tail for %s/%s: %s\n", self.Mid, self.Sid, err)
+		} else {
+			self.writeLogToWS(v.Conn, tail)
+		}
 		self.logcat.WsConns = append(self.logcat.WsConns, v.Conn)
 	case SpawnFileCmd:
 		self.SpawnFileServer(v.Sid, v.TerminalSid, v.Action, v.Filename)
@@ -239,7 +311,10 @@ func (self *ConnServer) Listen() {
 				continue
 			case FILE:
 				if self.Download.Ready {
-					self.forwardFileDownloadData(buf)
+					if err := self.forwardFileDownloadData(buf); err != nil {
+						log.Printf("download %s: %s, abort\n", self.Download.Name, err)
+						return
+					}
 					continue
 				}
 			}
@@ -276,7 +351,7 @@ func (self *ConnServer) Listen() {
 		case err := <-readErrChan:
 			if err == io.EOF {
 				if self.Download.Ready {
-					self.Download.Data <- nil
+					self.Download.Chunks.Close()
 					return
 				}
 				log.Printf("connection dropped: %s\n", self.Sid)
@@ -346,11 +421,12 @@ func (self *ConnServer) handleRegisterTargetSSHPortRequest(req *Request) error {
 
 func (self *ConnServer) handleRegisterRequest(req *Request) error {
 	type RequestArgs struct {
-		Sid        string                 `json:"sid"`
-		Mid        string                 `json:"mid"`
-		Mode       int                    `json:"mode"`
-		Format     int                    `json:"format"`
-		Properties map[string]interface{} `json:"properties"`
+		Sid         string                 `json:"sid"`
+		Mid         string                 `json:"mid"`
+		Mode        int                    `json:"mode"`
+		Format      int                    `json:"format"`
+		Properties  map[string]interface{} `json:"properties"`
+		ServerEntry *SignedServerEntry     `json:"server_entry"`
 	}
 
 	var args RequestArgs
@@ -365,6 +441,33 @@ func (self *ConnServer) handleRegisterRequest(req *Request) error {
 		}
 	}
 
+	if err := verifyMidMatchesCert(self.Conn, args.Mid); err != nil {
+		res := NewResponse(req.Rid, err.Error(), nil)
+		self.SendResponse(res)
+		return RegistrationFailedError(errors.New("handleRegisterRequest: " + err.Error()))
+	}
+
+	// A ghost provisioned from `overlord generate`'s bundle echoes back the
+	// SignedServerEntry it was shipped with; reject it if it doesn't verify
+	// against our own signing key, since that means it wasn't provisioned
+	// for this deployment. This authenticates the ghost to us; it is not
+	// what stops a rogue overlord from impersonating us to the ghost (see
+	// the comment on SignedServerEntry in deploy.go and PinnedTLSConfig in
+	// ghost_pinning.go for that side of the defense).
+	if self.ovl.signingPubKey != nil {
+		if args.ServerEntry == nil {
+			err := errors.New("handleRegisterRequest: no server_entry presented")
+			res := NewResponse(req.Rid, err.Error(), nil)
+			self.SendResponse(res)
+			return RegistrationFailedError(err)
+		}
+		if err := args.ServerEntry.Verify(self.ovl.signingPubKey); err != nil {
+			res := NewResponse(req.Rid, err.Error(), nil)
+			self.SendResponse(res)
+			return RegistrationFailedError(errors.New("handleRegisterRequest: " + err.Error()))
+		}
+	}
+
 	var err error
 	self.Sid = args.Sid
 	self.Mid = args.Mid
@@ -400,6 +503,7 @@ func (self *ConnServer) handleDownloadRequest(req *Request) error {
 		TerminalSid string `json:"terminal_sid"`
 		Filename    string `json:"filename"`
 		Size        int64  `json:"size"`
+		ResumeFrom  int64  `json:"resume_from"`
 	}
 
 	var args RequestArgs
@@ -411,6 +515,11 @@ func (self *ConnServer) handleDownloadRequest(req *Request) error {
 	self.TerminalSid = args.TerminalSid
 	self.Download.Name = args.Filename
 	self.Download.Size = args.Size
+	self.Download.Offset = args.ResumeFrom
+	// Allocated here, not in NewConnServer: most ConnServers (e.g. AGENT-mode
+	// ghosts that never download a file) should never pay for
+	// FILE_CHUNK_POOL_SIZE*FILE_CHUNK_SIZE of idle buffers.
+	self.Download.Chunks = NewChunkPool()
 
 	self.ovl.RegisterDownloadRequest(self)
 
@@ -419,10 +528,45 @@ func (self *ConnServer) handleDownloadRequest(req *Request) error {
 }
 
 func (self *ConnServer) handleClearToUploadRequest(req *Request) error {
+	type RequestArgs struct {
+		ResumeFrom int64 `json:"resume_from"`
+	}
+
+	var args RequestArgs
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &args); err != nil {
+			return err
+		}
+	}
+	self.Download.Offset = args.ResumeFrom
+
 	self.ovl.RegisterUploadRequest(self)
 	return nil
 }
 
+// handleRetryChunkRequest lets a ghost ask us to resend a chunk it received
+// with a bad CRC32C while *we* are the one streaming an upload to it (the
+// mirror image of ConnServer.RequestChunkRetry, which forwardFileDownloadData
+// sends when *we* detect corruption on a download). This handler resends
+// nothing itself; it records offset in Download.Offset for whatever drives
+// the upload stream to seek back to.
+func (self *ConnServer) handleRetryChunkRequest(req *Request) error {
+	type RequestArgs struct {
+		Offset int64 `json:"offset"`
+	}
+
+	var args RequestArgs
+	if err := json.Unmarshal(req.Params, &args); err != nil {
+		return err
+	}
+
+	log.Printf("retry_chunk requested for %s at offset %d\n", self.Download.Name, args.Offset)
+	self.Download.Offset = args.Offset
+
+	res := NewResponse(req.Rid, SUCCESS, nil)
+	return self.SendResponse(res)
+}
+
 func (self *ConnServer) handleRequest(req *Request) error {
 	var err error
 	switch req.Name {
@@ -438,6 +582,8 @@ func (self *ConnServer) handleRequest(req *Request) error {
 		err = self.handleRequestTargetSSHPortRequest(req)
 	case "register_target_ssh_port":
 		err = self.handleRegisterTargetSSHPortRequest(req)
+	case "retry_chunk":
+		err = self.handleRetryChunkRequest(req)
 	}
 	return err
 }
@@ -0,0 +1,317 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SIGNING_KEY_FILENAME    = "signing-key.pem"
+	SIGNING_PUBKEY_FILENAME = "signing-key.pub.pem"
+	OVERLORD_CONFIG_NAME    = "overlord.json"
+	GHOST_CONFIG_NAME       = "ghost.json"
+	SERVER_ENTRY_NAME       = "server_entry.json"
+)
+
+// ServerEntry is the subset of a deployment's identity a ghost needs to
+// trust the overlord it's dialing, instead of the current
+// trust-on-first-connect handshake: the CA public key it should pin plus
+// the host/ports it was generated for.
+type ServerEntry struct {
+	CAPublicKey       []byte `json:"ca_public_key"`
+	Host              string `json:"host"`
+	RPCPort           int    `json:"rpc_port"`
+	HTTPPort          int    `json:"http_port"`
+	TargetSSHPortLow  int    `json:"target_ssh_port_start"`
+	TargetSSHPortHigh int    `json:"target_ssh_port_end"`
+}
+
+// SignedServerEntry is what `overlord generate` writes to disk and what a
+// ghost ships with and echoes back during registration: the entry plus a
+// detached ed25519 signature over its canonical JSON encoding, so
+// ConnServer.handleRegisterRequest can reject a ghost that wasn't
+// provisioned from this deployment's bundle. This authenticates the ghost
+// to the overlord, not the other way around: it does nothing against a
+// rogue overlord, which controls its own verification and could simply
+// skip this check or accept anything. Defending a ghost against a rogue
+// overlord is PinnedTLSConfig's job (see ghost_pinning.go), which pins the
+// CA public key carried in the same ServerEntry.
+type SignedServerEntry struct {
+	Entry     ServerEntry `json:"entry"`
+	Signature []byte      `json:"signature"`
+}
+
+// OverlordConfig is the full on-disk config for `overlord run`: listen
+// ports, TLS material, SSH forwarding range and admin credentials.
+type OverlordConfig struct {
+	ListenAddr        string `json:"listen_addr"`
+	RPCPort           int    `json:"rpc_port"`
+	HTTPPort          int    `json:"http_port"`
+	TLSStateDir       string `json:"tls_state_dir"`
+	TargetSSHPortLow  int    `json:"target_ssh_port_start"`
+	TargetSSHPortHigh int    `json:"target_ssh_port_end"`
+	AdminUser         string `json:"admin_user"`
+	AdminPasswordHash string `json:"admin_password_hash"`
+	SigningPubKeyPath string `json:"signing_pub_key_path"`
+}
+
+// GhostConfig is the matching ghost-side config shipped alongside a signed
+// ServerEntry, so a device can be imaged with a bundle instead of
+// hand-configured `-overlord-host`/`-overlord-port`-style flags.
+type GhostConfig struct {
+	OverlordHost string `json:"overlord_host"`
+	RPCPort      int    `json:"rpc_port"`
+	Mid          string `json:"mid,omitempty"`
+}
+
+// GenerateOptions mirrors the flags Psiphon's server binary takes for its
+// own "generate" subcommand (-ipaddress, -port, ...), adapted to Overlord's
+// ports instead of Psiphon's obfuscated-SSH ones.
+type GenerateOptions struct {
+	IPAddress         string
+	RPCPort           int
+	HTTPPort          int
+	TargetSSHPortLow  int
+	TargetSSHPortHigh int
+	AdminUser         string
+	AdminPassword     string
+}
+
+// GenerateBundle writes a complete deployment under dir: overlord.json,
+// ghost.json, a fresh mTLS CA (via NewCertManager, see tls_manager.go), a
+// signing keypair, and a SignedServerEntry a ghost can be shipped with.
+func GenerateBundle(dir string, opts GenerateOptions) error {
+	if opts.IPAddress == "" {
+		return errors.New("GenerateBundle: -ipaddress is required")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	certMgr, err := NewCertManager(filepath.Join(dir, "tls"))
+	if err != nil {
+		return fmt.Errorf("GenerateBundle: %w", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("GenerateBundle: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	if err := os.WriteFile(filepath.Join(dir, SIGNING_KEY_FILENAME), keyPEM, 0600); err != nil {
+		return err
+	}
+
+	// The public half is what `overlord run` needs back (as signingPubKey)
+	// to verify a ghost's SignedServerEntry in handleRegisterRequest; unlike
+	// priv it isn't secret, so it's written PKIX/world-readable alongside
+	// the bundle instead of folded into the 0600 private key file.
+	pkixPub, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("GenerateBundle: %w", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixPub})
+	signingPubKeyPath := filepath.Join(dir, SIGNING_PUBKEY_FILENAME)
+	if err := os.WriteFile(signingPubKeyPath, pubPEM, 0644); err != nil {
+		return err
+	}
+
+	entry := ServerEntry{
+		CAPublicKey:       certMgr.caPublicKeyDER(),
+		Host:              opts.IPAddress,
+		RPCPort:           opts.RPCPort,
+		HTTPPort:          opts.HTTPPort,
+		TargetSSHPortLow:  opts.TargetSSHPortLow,
+		TargetSSHPortHigh: opts.TargetSSHPortHigh,
+	}
+	signed, err := SignServerEntry(entry, priv)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, SERVER_ENTRY_NAME), signed); err != nil {
+		return err
+	}
+
+	passwordHash, err := hashPassword(opts.AdminPassword)
+	if err != nil {
+		return fmt.Errorf("GenerateBundle: %w", err)
+	}
+	overlordCfg := OverlordConfig{
+		ListenAddr:        "0.0.0.0",
+		RPCPort:           opts.RPCPort,
+		HTTPPort:          opts.HTTPPort,
+		TLSStateDir:       filepath.Join(dir, "tls"),
+		TargetSSHPortLow:  opts.TargetSSHPortLow,
+		TargetSSHPortHigh: opts.TargetSSHPortHigh,
+		AdminUser:         opts.AdminUser,
+		AdminPasswordHash: passwordHash,
+		SigningPubKeyPath: signingPubKeyPath,
+	}
+	if err := writeJSON(filepath.Join(dir, OVERLORD_CONFIG_NAME), overlordCfg); err != nil {
+		return err
+	}
+
+	ghostCfg := GhostConfig{OverlordHost: opts.IPAddress, RPCPort: opts.RPCPort}
+	if err := writeJSON(filepath.Join(dir, GHOST_CONFIG_NAME), ghostCfg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LoadSigningPubKey reads the PKIX/PEM-encoded ed25519 public key GenerateBundle
+// wrote to path (see OverlordConfig.SigningPubKeyPath), for `overlord run` to
+// populate signingPubKey with.
+func LoadSigningPubKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("LoadSigningPubKey: %s: not a PEM-encoded PUBLIC KEY", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadSigningPubKey: %w", err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("LoadSigningPubKey: %s: not an ed25519 public key", path)
+	}
+	return pub, nil
+}
+
+// SignServerEntry signs entry's canonical JSON encoding with priv.
+func SignServerEntry(entry ServerEntry, priv ed25519.PrivateKey) (*SignedServerEntry, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedServerEntry{Entry: entry, Signature: ed25519.Sign(priv, payload)}, nil
+}
+
+// Verify checks self.Signature against self.Entry using pub, the signing
+// public key an overlord deployment was generated with.
+func (self *SignedServerEntry) Verify(pub ed25519.PublicKey) error {
+	payload, err := json.Marshal(self.Entry)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, payload, self.Signature) {
+		return errors.New("SignedServerEntry.Verify: signature does not match entry")
+	}
+	return nil
+}
+
+// LoadConfigs merges one or more config files (later files override earlier
+// ones, field by field), mirroring the repeatable `-config` flag Psiphon's
+// server binary supports for multi-file merges.
+func LoadConfigs(paths []string) (*OverlordConfig, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("LoadConfigs: at least one -config is required")
+	}
+
+	merged := &OverlordConfig{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var cfg OverlordConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("LoadConfigs: %s: %w", path, err)
+		}
+		mergeOverlordConfig(merged, &cfg)
+	}
+	return merged, nil
+}
+
+func mergeOverlordConfig(dst, src *OverlordConfig) {
+	if src.ListenAddr != "" {
+		dst.ListenAddr = src.ListenAddr
+	}
+	if src.RPCPort != 0 {
+		dst.RPCPort = src.RPCPort
+	}
+	if src.HTTPPort != 0 {
+		dst.HTTPPort = src.HTTPPort
+	}
+	if src.TLSStateDir != "" {
+		dst.TLSStateDir = src.TLSStateDir
+	}
+	if src.TargetSSHPortLow != 0 {
+		dst.TargetSSHPortLow = src.TargetSSHPortLow
+	}
+	if src.TargetSSHPortHigh != 0 {
+		dst.TargetSSHPortHigh = src.TargetSSHPortHigh
+	}
+	if src.AdminUser != "" {
+		dst.AdminUser = src.AdminUser
+	}
+	if src.AdminPasswordHash != "" {
+		dst.AdminPasswordHash = src.AdminPasswordHash
+	}
+	if src.SigningPubKeyPath != "" {
+		dst.SigningPubKeyPath = src.SigningPubKeyPath
+	}
+}
+
+// Validate checks that a loaded OverlordConfig is complete enough to bind
+// sockets against, so `overlord run` fails fast on a bad bundle instead of
+// halfway through startup.
+func (self *OverlordConfig) Validate() error {
+	if self.ListenAddr == "" {
+		return errors.New("OverlordConfig: listen_addr is required")
+	}
+	if self.RPCPort <= 0 || self.HTTPPort <= 0 {
+		return errors.New("OverlordConfig: rpc_port and http_port must be set")
+	}
+	if self.TargetSSHPortLow <= 0 || self.TargetSSHPortHigh < self.TargetSSHPortLow {
+		return errors.New("OverlordConfig: invalid target SSH port range")
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// hashPassword bcrypt-hashes the bundle's admin credentials for storage in
+// OverlordConfig.AdminPasswordHash; checkPassword is its counterpart for the
+// dashboard's login path.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password matches hash, as produced by
+// hashPassword.
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSignServerEntryVerifyRoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	entry := ServerEntry{
+		CAPublicKey: []byte("fake-ca-pubkey"),
+		Host:        "overlord.example.com",
+		RPCPort:     4455,
+		HTTPPort:    9000,
+	}
+
+	signed, err := SignServerEntry(entry, priv)
+	if err != nil {
+		t.Fatalf("SignServerEntry: %s", err)
+	}
+	if err := signed.Verify(pub); err != nil {
+		t.Fatalf("Verify of an untampered entry failed: %s", err)
+	}
+}
+
+func TestSignedServerEntryVerifyRejectsTampering(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	entry := ServerEntry{Host: "overlord.example.com", RPCPort: 4455, HTTPPort: 9000}
+	signed, err := SignServerEntry(entry, priv)
+	if err != nil {
+		t.Fatalf("SignServerEntry: %s", err)
+	}
+
+	signed.Entry.Host = "evil.example.com"
+	if err := signed.Verify(pub); err == nil {
+		t.Fatalf("Verify should reject an entry modified after signing")
+	}
+}
+
+func TestSignedServerEntryVerifyRejectsWrongKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	entry := ServerEntry{Host: "overlord.example.com", RPCPort: 4455, HTTPPort: 9000}
+	signed, err := SignServerEntry(entry, priv)
+	if err != nil {
+		t.Fatalf("SignServerEntry: %s", err)
+	}
+
+	if err := signed.Verify(otherPub); err == nil {
+		t.Fatalf("Verify should reject a signature checked against the wrong public key")
+	}
+}
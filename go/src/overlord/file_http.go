@@ -0,0 +1,39 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// HandleFileDownload streams cs.Download's chunk pool to w as it arrives
+// from the ghost, releasing each chunk's buffer back to the pool once
+// written so the producer in ConnServer.forwardFileDownloadData can reuse
+// it for the next chunk. Registered by Overlord's HTTP mux for the existing
+// file download endpoint; replaces the old `for buf := range cs.Download.Data`
+// loop that had no bound on how far producer could run ahead of consumer.
+func HandleFileDownload(w http.ResponseWriter, cs *ConnServer) {
+	w.Header().Set("Content-Disposition", "attachment; filename="+cs.Download.Name)
+	if cs.Download.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(cs.Download.Size, 10))
+	}
+
+	for {
+		chunk, ok := cs.Download.Chunks.Receive()
+		if !ok {
+			return
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			log.Printf("HandleFileDownload: %s: %s\n", cs.Download.Name, err)
+			return
+		}
+		cs.Download.Chunks.Release(chunk)
+		if chunk.EOF {
+			return
+		}
+	}
+}
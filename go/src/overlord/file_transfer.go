@@ -0,0 +1,199 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	// FILE_CHUNK_SIZE bounds how much of a transfer is ever held in memory
+	// at once in the FileDownloadContext chunk pool, replacing the old
+	// unbounded `chan []byte` that let a fast ghost OOM a slow HTTP client.
+	FILE_CHUNK_SIZE = 64 * 1024
+
+	// FILE_CHUNK_POOL_SIZE is the number of in-flight chunk buffers; this is
+	// the backpressure knob: the ConnServer read loop blocks in
+	// forwardFileDownloadData, and so stops reading from the ghost, once
+	// this many chunks are checked out and not yet Released.
+	FILE_CHUNK_POOL_SIZE = 4
+
+	// fileFrameHeaderSize is len(offset) + len(length|eof) + len(crc32c).
+	fileFrameHeaderSize = 8 + 4 + 4
+
+	fileFrameEOFBit = uint32(1) << 31
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileChunk is one fixed-size (at most FILE_CHUNK_SIZE) slice of a transfer,
+// framed on the wire as:
+//
+//	offset   uint64 (8 bytes, big endian)
+//	length   uint32 (4 bytes, big endian, high bit set on the final chunk)
+//	crc32c   uint32 (4 bytes, big endian, over Data)
+//	data     length&0x7fffffff bytes
+//
+// so that request_to_download/clear_to_upload can carry a resume_from
+// offset and a receiver can ask for a specific chunk again with
+// retry_chunk on a CRC mismatch.
+type FileChunk struct {
+	Offset int64
+	Data   []byte
+	CRC32C uint32
+	EOF    bool
+}
+
+func (self *FileChunk) VerifyCRC() bool {
+	return crc32.Checksum(self.Data, crc32cTable) == self.CRC32C
+}
+
+// fileFrameParser reassembles FileChunks out of a byte stream that may
+// split a frame across multiple Listen() reads, the same way
+// ConnServer.ReadBuffer already handles partial JSON-RPC lines.
+type fileFrameParser struct {
+	buf []byte
+}
+
+// Feed appends buf to the parser's internal buffer and returns every
+// complete FileChunk it can extract; any trailing partial frame is kept
+// for the next call. It returns an error, and stops parsing, if a frame
+// claims to carry more than FILE_CHUNK_SIZE bytes: ChunkPool.Send copies
+// each chunk's Data into a fixed FILE_CHUNK_SIZE buffer, so letting an
+// oversized frame through here would silently truncate it downstream,
+// after VerifyCRC has already checked the untruncated bytes.
+func (self *fileFrameParser) Feed(buf []byte) ([]*FileChunk, error) {
+	self.buf = append(self.buf, buf...)
+
+	var chunks []*FileChunk
+	for {
+		if len(self.buf) < fileFrameHeaderSize {
+			break
+		}
+
+		offset := int64(binary.BigEndian.Uint64(self.buf[0:8]))
+		lengthAndEOF := binary.BigEndian.Uint32(self.buf[8:12])
+		crc := binary.BigEndian.Uint32(self.buf[12:16])
+		length := lengthAndEOF &^ fileFrameEOFBit
+		eof := lengthAndEOF&fileFrameEOFBit != 0
+
+		if length > FILE_CHUNK_SIZE {
+			return chunks, fmt.Errorf("fileFrameParser: frame at offset %d claims %d bytes, over FILE_CHUNK_SIZE (%d)", offset, length, FILE_CHUNK_SIZE)
+		}
+
+		total := fileFrameHeaderSize + int(length)
+		if len(self.buf) < total {
+			break
+		}
+
+		data := make([]byte, length)
+		copy(data, self.buf[fileFrameHeaderSize:total])
+		chunks = append(chunks, &FileChunk{Offset: offset, Data: data, CRC32C: crc, EOF: eof})
+
+		self.buf = self.buf[total:]
+	}
+	return chunks, nil
+}
+
+// EncodeFileChunk is the ghost-side counterpart of fileFrameParser: it's
+// kept here too since both ends of this protocol need to agree on the
+// framing, and the ghost build in this repo links against this package.
+func EncodeFileChunk(offset int64, data []byte, eof bool) []byte {
+	lengthAndEOF := uint32(len(data))
+	if eof {
+		lengthAndEOF |= fileFrameEOFBit
+	}
+
+	out := make([]byte, fileFrameHeaderSize+len(data))
+	binary.BigEndian.PutUint64(out[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(out[8:12], lengthAndEOF)
+	binary.BigEndian.PutUint32(out[12:16], crc32.Checksum(data, crc32cTable))
+	copy(out[fileFrameHeaderSize:], data)
+	return out
+}
+
+// ChunkPool is a bounded handoff between the ConnServer read loop
+// (producer) and whatever is consuming a download over HTTP (consumer),
+// built around a fixed set of FILE_CHUNK_SIZE buffers that are actually
+// reused rather than allocated per chunk: Send copies data into a buffer
+// taken from emptyBuffer, and the consumer must call Release once it's done
+// with a received chunk so that buffer goes back into circulation. The
+// producer blocks in Send once every buffer is checked out, which is the
+// backpressure: while it is blocked, the ConnServer read loop that called
+// Send handles nothing else, and at most FILE_CHUNK_POOL_SIZE chunks of the
+// transfer are ever held in memory, however fast the ghost sends.
+type ChunkPool struct {
+	emptyBuffer   chan []byte
+	partialBuffer chan *FileChunk
+	closed        chan struct{}
+}
+
+func NewChunkPool() *ChunkPool {
+	pool := &ChunkPool{
+		emptyBuffer:   make(chan []byte, FILE_CHUNK_POOL_SIZE),
+		partialBuffer: make(chan *FileChunk, FILE_CHUNK_POOL_SIZE),
+		closed:        make(chan struct{}),
+	}
+	for i := 0; i < FILE_CHUNK_POOL_SIZE; i++ {
+		pool.emptyBuffer <- make([]byte, FILE_CHUNK_SIZE)
+	}
+	return pool
+}
+
+// Send copies data into a recycled FILE_CHUNK_SIZE buffer (blocking until
+// one is free or the pool is closed) and hands it to the consumer. It
+// returns false if the pool was closed first. data must be at most
+// FILE_CHUNK_SIZE bytes; fileFrameParser.Feed is what enforces that on the
+// way in, so this never has to truncate (and silently corrupt) a chunk
+// that already passed CRC verification.
+func (self *ChunkPool) Send(offset int64, data []byte, eof bool) bool {
+	var buf []byte
+	select {
+	case buf = <-self.emptyBuffer:
+	case <-self.closed:
+		return false
+	}
+
+	n := copy(buf[:cap(buf)], data)
+	chunk := &FileChunk{Offset: offset, Data: buf[:n], EOF: eof}
+
+	select {
+	case self.partialBuffer <- chunk:
+		return true
+	case <-self.closed:
+		return false
+	}
+}
+
+// Receive blocks until a chunk is available or the pool is closed. The
+// caller must pass the chunk to Release once done with its Data.
+func (self *ChunkPool) Receive() (*FileChunk, bool) {
+	select {
+	case chunk := <-self.partialBuffer:
+		return chunk, true
+	case <-self.closed:
+		return nil, false
+	}
+}
+
+// Release returns chunk's underlying buffer to the pool so the producer can
+// reuse it for a future chunk. Callers must not touch chunk.Data afterwards.
+func (self *ChunkPool) Release(chunk *FileChunk) {
+	buf := chunk.Data[:cap(chunk.Data)]
+	select {
+	case self.emptyBuffer <- buf:
+	case <-self.closed:
+	}
+}
+
+func (self *ChunkPool) Close() {
+	select {
+	case <-self.closed:
+	default:
+		close(self.closed)
+	}
+}
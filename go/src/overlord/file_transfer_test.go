@@ -0,0 +1,127 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileFrameParserRoundTrip(t *testing.T) {
+	frame1 := EncodeFileChunk(0, []byte("hello"), false)
+	frame2 := EncodeFileChunk(5, []byte("world"), true)
+
+	var parser fileFrameParser
+
+	// Feed the two frames split across three arbitrary reads to exercise
+	// the partial-frame buffering path.
+	chunks, err := parser.Feed(frame1[:3])
+	if err != nil {
+		t.Fatalf("Feed: %s", err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("expected no complete chunks from a partial frame, got %d", len(chunks))
+	}
+
+	chunks, err = parser.Feed(append(frame1[3:], frame2[:4]...))
+	if err != nil {
+		t.Fatalf("Feed: %s", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 complete chunk, got %d", len(chunks))
+	}
+	if chunks[0].Offset != 0 || string(chunks[0].Data) != "hello" || chunks[0].EOF {
+		t.Fatalf("unexpected chunk: %+v", chunks[0])
+	}
+	if !chunks[0].VerifyCRC() {
+		t.Fatalf("chunk failed its own CRC32C check")
+	}
+
+	chunks, err = parser.Feed(frame2[4:])
+	if err != nil {
+		t.Fatalf("Feed: %s", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 complete chunk, got %d", len(chunks))
+	}
+	if chunks[0].Offset != 5 || string(chunks[0].Data) != "world" || !chunks[0].EOF {
+		t.Fatalf("unexpected chunk: %+v", chunks[0])
+	}
+	if !chunks[0].VerifyCRC() {
+		t.Fatalf("chunk failed its own CRC32C check")
+	}
+}
+
+// TestFileFrameParserRejectsOversizedFrame checks that a frame claiming
+// more than FILE_CHUNK_SIZE bytes is rejected here, rather than being let
+// through and silently truncated later by ChunkPool.Send's fixed-size
+// buffer copy.
+func TestFileFrameParserRejectsOversizedFrame(t *testing.T) {
+	oversized := make([]byte, FILE_CHUNK_SIZE+1)
+	frame := EncodeFileChunk(0, oversized, false)
+
+	var parser fileFrameParser
+	if _, err := parser.Feed(frame); err == nil {
+		t.Fatalf("expected Feed to reject a frame over FILE_CHUNK_SIZE")
+	}
+}
+
+func TestChunkPoolRecyclesBuffers(t *testing.T) {
+	pool := NewChunkPool()
+
+	if !pool.Send(0, []byte("abc"), false) {
+		t.Fatalf("Send on a fresh pool should not block or fail")
+	}
+	chunk, ok := pool.Receive()
+	if !ok {
+		t.Fatalf("Receive should return the chunk just sent")
+	}
+	if !bytes.Equal(chunk.Data, []byte("abc")) {
+		t.Fatalf("got %q, want %q", chunk.Data, "abc")
+	}
+	sentBuf := chunk.Data[:cap(chunk.Data)]
+
+	pool.Release(chunk)
+
+	// Draining every buffer out of emptyBuffer should recover exactly the
+	// same backing arrays Release put back, proving Send/Release actually
+	// recycle buffers instead of allocating fresh ones per chunk.
+	seenRecycled := false
+	for i := 0; i < FILE_CHUNK_POOL_SIZE; i++ {
+		buf := <-pool.emptyBuffer
+		if &buf[0] == &sentBuf[0] {
+			seenRecycled = true
+		}
+	}
+	if !seenRecycled {
+		t.Fatalf("Release did not return the released buffer to emptyBuffer")
+	}
+}
+
+func TestChunkPoolCloseUnblocksSendAndReceive(t *testing.T) {
+	pool := NewChunkPool()
+	for i := 0; i < FILE_CHUNK_POOL_SIZE; i++ {
+		if !pool.Send(0, []byte("x"), false) {
+			t.Fatalf("Send %d should have succeeded before the pool filled up", i)
+		}
+	}
+
+	pool.Close()
+
+	if pool.Send(0, []byte("x"), false) {
+		t.Fatalf("Send on a closed, full pool should report failure")
+	}
+
+	// Once closed, Receive must not block forever; whether it still
+	// surfaces already-buffered chunks or reports closed is a select-order
+	// race (both partialBuffer and closed are ready), so we only assert
+	// termination, draining until it reports closed.
+	for i := 0; i < FILE_CHUNK_POOL_SIZE+1; i++ {
+		if _, ok := pool.Receive(); !ok {
+			return
+		}
+	}
+	t.Fatalf("Receive never reported the pool as closed")
+}
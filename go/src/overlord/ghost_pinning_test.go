@@ -0,0 +1,139 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func generateTestCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	return cert, key
+}
+
+func TestPinnedTLSConfigAcceptsPinnedCA(t *testing.T) {
+	caCert, caKey := generateTestCA(t)
+	spki, err := x509.MarshalPKIXPublicKey(&caKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %s", err)
+	}
+
+	entry := &ServerEntry{CAPublicKey: spki}
+	if err := entry.verifyPinnedChain([][]byte{caCert.Raw}); err != nil {
+		t.Fatalf("verifyPinnedChain rejected the pinned CA cert: %s", err)
+	}
+}
+
+func TestPinnedTLSConfigRejectsOtherCA(t *testing.T) {
+	_, pinnedKey := generateTestCA(t)
+	pinnedSpki, err := x509.MarshalPKIXPublicKey(&pinnedKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %s", err)
+	}
+
+	rogueCert, _ := generateTestCA(t)
+
+	entry := &ServerEntry{CAPublicKey: pinnedSpki}
+	if err := entry.verifyPinnedChain([][]byte{rogueCert.Raw}); err == nil {
+		t.Fatalf("verifyPinnedChain accepted a chain signed by an unpinned (rogue) CA")
+	}
+}
+
+// TestPinnedTLSConfigRejectsSpoofedCAAlongsideRogueLeaf is a regression test
+// for a bug where verifyPinnedChain accepted a handshake as long as the
+// pinned CA's public key appeared *anywhere* in rawCerts, without checking
+// that the presented leaf was actually signed by it. The real CA cert isn't
+// secret — every ghost sees it in every handshake, and it ships in the
+// generated bundle — so a rogue overlord could attach the real CA cert
+// bytes alongside its own unrelated, self-signed leaf and pass the pin
+// check even though the leaf has no cryptographic relationship to the
+// pinned CA.
+func TestPinnedTLSConfigRejectsSpoofedCAAlongsideRogueLeaf(t *testing.T) {
+	realCA, realCAKey := generateTestCA(t)
+	pinnedSpki, err := x509.MarshalPKIXPublicKey(&realCAKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %s", err)
+	}
+
+	rogueLeaf, _ := generateTestCA(t) // unrelated self-signed cert, not signed by realCA
+
+	entry := &ServerEntry{CAPublicKey: pinnedSpki}
+	if err := entry.verifyPinnedChain([][]byte{rogueLeaf.Raw, realCA.Raw}); err == nil {
+		t.Fatalf("verifyPinnedChain accepted a rogue leaf merely because the real CA cert rode along in rawCerts")
+	}
+}
+
+// TestPinnedTLSConfigAcceptsRealServerChain drives an actual TLS handshake
+// between CertManager.ServerTLSConfig() and a ghost using PinnedTLSConfig,
+// instead of hand-building the rawCerts slice verifyPinnedChain sees above:
+// ServerTLSConfig presents the chain GenerateAndSaveServerCert wrote to
+// cert.pem, and verifyPinnedChain can only match the pinned key if the CA
+// cert rides along after the leaf, so unless GenerateAndSaveServerCert
+// bundles the CA cert into that chain, this handshake fails with "bad
+// certificate" even though the unit tests above pass.
+func TestPinnedTLSConfigAcceptsRealServerChain(t *testing.T) {
+	certMgr, err := NewCertManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewCertManager: %s", err)
+	}
+
+	clientCertPEM, clientKeyPEM, err := certMgr.IssueClientCert("test-ghost")
+	if err != nil {
+		t.Fatalf("IssueClientCert: %s", err)
+	}
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %s", err)
+	}
+
+	entry := &ServerEntry{CAPublicKey: certMgr.caPublicKeyDER()}
+	clientCfg := entry.PinnedTLSConfig()
+	clientCfg.Certificates = []tls.Certificate{clientCert}
+
+	serverConn, clientConn := net.Pipe()
+	server := tls.Server(serverConn, certMgr.ServerTLSConfig())
+	client := tls.Client(clientConn, clientCfg)
+	defer server.Close()
+	defer client.Close()
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client Handshake against the real server-issued chain: %s", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server Handshake: %s", err)
+	}
+}
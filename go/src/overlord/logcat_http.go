@@ -0,0 +1,38 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// HandleLogcatHistoryDownload serves the full history for a (mid, sid)
+// logcat session from self.ovl.logcatStore, gzip-compressed, so operators
+// can grab factory logs after a device reboots even if nobody had the
+// logcat tab open at the time. Registered by Overlord's HTTP mux alongside
+// the other /api/ handlers under something like
+// "/api/log/download/{mid}/{sid}".
+func (self *Overlord) HandleLogcatHistoryDownload(w http.ResponseWriter, mid, sid string) {
+	rc, err := self.logcatStore.OpenRawHistory(mid, sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", mid+"-"+sid+".log.gz"))
+
+	// OpenRawHistory hands back the on-disk segments' bytes as-is: a
+	// concatenation of gzip members is itself a valid gzip stream (RFC
+	// 1952), so there's no need to decompress and re-gzip through a fresh
+	// gzip.Writer the way reading via OpenHistory would require.
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("HandleLogcatHistoryDownload: failed to stream history for %s/%s: %s\n", mid, sid, err)
+	}
+}
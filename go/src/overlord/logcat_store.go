@@ -0,0 +1,546 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LOGCAT_SEGMENT_BYTES is the size at which a segment is rotated, so the
+	// eviction loop can drop whole files instead of rewriting one giant log.
+	LOGCAT_SEGMENT_BYTES = 1024 * 1024 // 1 MiB per segment, before compression
+
+	// LOGCAT_DEFAULT_BUDGET_BYTES and LOGCAT_DEFAULT_MAX_AGE are the
+	// fallbacks used when NewLogcatStore is given zero values.
+	LOGCAT_DEFAULT_BUDGET_BYTES = 64 * 1024 * 1024
+	LOGCAT_DEFAULT_MAX_AGE      = 7 * 24 * time.Hour
+
+	LOGCAT_EVICT_INTERVAL = 5 * time.Minute
+
+	// LOGCAT_TAIL_BYTES is how much of the on-disk history gets replayed to
+	// a websocket that joins a logcat session late.
+	LOGCAT_TAIL_BYTES = LOG_BUFSIZ
+
+	// LOGCAT_FLUSH_BYTES and LOGCAT_FLUSH_INTERVAL bound how much of the
+	// live segment can sit in an unfinished gzip member. A flush (see
+	// flushLocked) closes out the current gzip member so a reader can catch
+	// up to data written so far, but every member carries its own header
+	// and footer, so doing it on every Append (one per incoming log chunk)
+	// can offset or exceed whatever compression gzip bought on
+	// small/high-rate writes; Append flushes once enough bytes have
+	// buffered or enough time has passed since the last flush, whichever
+	// comes first.
+	LOGCAT_FLUSH_BYTES    = 16 * 1024
+	LOGCAT_FLUSH_INTERVAL = 2 * time.Second
+)
+
+// LogcatStore persists logcat output for every (Mid, Sid) session to a
+// segmented, gzip-compressed log under baseDir, replacing the in-memory
+// 16 KiB LogcatContext.History ring that used to be dropped on disconnect.
+// Layout: <baseDir>/<mid>/<sid>/<segment-start-unixnano>.log.gz
+type LogcatStore struct {
+	baseDir    string
+	budgetSize int64
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*logcatStream // key: mid + "/" + sid
+
+	stopEvict chan bool
+}
+
+type logcatStream struct {
+	mu         sync.Mutex
+	dir        string
+	file       *os.File
+	gz         *gzip.Writer
+	segmentLen int64
+	unflushed  int64
+	lastFlush  time.Time
+}
+
+func logcatKey(mid, sid string) string {
+	return mid + "/" + sid
+}
+
+// isSafePathComponent reports whether s is safe to use as a single
+// filesystem path component under baseDir. mid/sid reach here straight from
+// a ghost's Register request (handleRegisterRequest only checks that
+// they're non-empty), so without this a mid like "../../../../tmp/evil"
+// would make getStream/segments read, write and evict files anywhere on
+// disk instead of under baseDir.
+func isSafePathComponent(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\")
+}
+
+// NewLogcatStore creates (or reopens) a store rooted at baseDir and starts
+// its background eviction loop. maxBytes/maxAge of 0 fall back to
+// LOGCAT_DEFAULT_BUDGET_BYTES/LOGCAT_DEFAULT_MAX_AGE.
+func NewLogcatStore(baseDir string, maxBytes int64, maxAge time.Duration) (*LogcatStore, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, err
+	}
+	if maxBytes == 0 {
+		maxBytes = LOGCAT_DEFAULT_BUDGET_BYTES
+	}
+	if maxAge == 0 {
+		maxAge = LOGCAT_DEFAULT_MAX_AGE
+	}
+
+	store := &LogcatStore{
+		baseDir:    baseDir,
+		budgetSize: maxBytes,
+		maxAge:     maxAge,
+		streams:    make(map[string]*logcatStream),
+		stopEvict:  make(chan bool, 1),
+	}
+	go store.evictLoop()
+	return store, nil
+}
+
+func (self *LogcatStore) Close() {
+	self.stopEvict <- true
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, s := range self.streams {
+		s.close()
+	}
+}
+
+// Append writes buf through to the on-disk compressed log for (mid, sid),
+// rotating to a new segment if the current one has grown past
+// LOGCAT_SEGMENT_BYTES.
+func (self *LogcatStore) Append(mid, sid string, buf []byte) error {
+	stream, err := self.getStream(mid, sid)
+	if err != nil {
+		return err
+	}
+	return stream.append(buf)
+}
+
+func (self *LogcatStore) getStream(mid, sid string) (*logcatStream, error) {
+	if !isSafePathComponent(mid) || !isSafePathComponent(sid) {
+		return nil, fmt.Errorf("logcat store: invalid mid/sid %q/%q", mid, sid)
+	}
+
+	key := logcatKey(mid, sid)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if stream, ok := self.streams[key]; ok {
+		return stream, nil
+	}
+
+	dir := filepath.Join(self.baseDir, mid, sid)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stream := &logcatStream{dir: dir}
+	self.streams[key] = stream
+	return stream, nil
+}
+
+func (self *logcatStream) append(buf []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.file == nil || self.segmentLen >= LOGCAT_SEGMENT_BYTES {
+		if err := self.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := self.gz.Write(buf)
+	self.segmentLen += int64(n)
+	self.unflushed += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if self.unflushed < LOGCAT_FLUSH_BYTES && time.Since(self.lastFlush) < LOGCAT_FLUSH_INTERVAL {
+		return nil
+	}
+	return self.flushLocked()
+}
+
+// flushLocked closes out the segment's current gzip member and opens a
+// fresh one in the same file, so a concurrent reader (Tail, OpenHistory,
+// OpenRawHistory) can catch up to everything written so far. This is
+// deliberately Close, not Flush: Flush only emits a sync-point within an
+// still-open deflate stream, which gzip.Reader can't treat as a complete
+// member on its own (see segmentReader.Read), so handing raw bytes to an
+// HTTP client the way OpenRawHistory does would truncate mid-member.
+// Closing and reopening costs a little more compression ratio than a bare
+// sync-flush would, same as rotate() costs between segments, but it means
+// every flush point is a real member boundary instead of a special case
+// only the decompressing readers know how to tolerate.
+func (self *logcatStream) flushLocked() error {
+	if err := self.gz.Close(); err != nil {
+		return err
+	}
+	self.gz = gzip.NewWriter(self.file)
+	self.unflushed = 0
+	self.lastFlush = time.Now()
+	return nil
+}
+
+func (self *logcatStream) flushNow() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.gz == nil {
+		return nil
+	}
+	return self.flushLocked()
+}
+
+func (self *logcatStream) rotate() error {
+	if self.gz != nil {
+		self.gz.Close()
+		self.file.Close()
+	}
+
+	name := fmt.Sprintf("%d.log.gz", time.Now().UnixNano())
+	f, err := os.OpenFile(filepath.Join(self.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	self.file = f
+	self.gz = gzip.NewWriter(f)
+	self.segmentLen = 0
+	self.unflushed = 0
+	self.lastFlush = time.Time{}
+	return nil
+}
+
+func (self *logcatStream) close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.gz != nil {
+		self.gz.Close()
+		self.file.Close()
+	}
+}
+
+// currentPath returns the path of the segment this stream is currently
+// writing to, or "" before its first Append has opened one.
+func (self *logcatStream) currentPath() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.file == nil {
+		return ""
+	}
+	return self.file.Name()
+}
+
+// segments returns the session's segment files sorted oldest-first.
+func (self *LogcatStore) segments(mid, sid string) ([]string, error) {
+	if !isSafePathComponent(mid) || !isSafePathComponent(sid) {
+		return nil, fmt.Errorf("logcat store: invalid mid/sid %q/%q", mid, sid)
+	}
+
+	dir := filepath.Join(self.baseDir, mid, sid)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(names) // filenames are zero-padded-free unix nanos but still sort correctly for any realistic timespan
+	return names, nil
+}
+
+// flushStream flushes (mid, sid)'s live segment, if one is open, so a
+// reader started right after it sees everything written so far.
+func (self *LogcatStore) flushStream(mid, sid string) error {
+	self.mu.Lock()
+	stream, ok := self.streams[logcatKey(mid, sid)]
+	self.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return stream.flushNow()
+}
+
+// OpenHistory returns an io.ReadCloser that streams the full, decompressed
+// history for (mid, sid) across every on-disk segment, oldest first. Tail
+// reads through this; the HTTP download endpoint uses OpenRawHistory
+// instead.
+func (self *LogcatStore) OpenHistory(mid, sid string) (io.ReadCloser, error) {
+	if err := self.flushStream(mid, sid); err != nil {
+		return nil, err
+	}
+	names, err := self.segments(mid, sid)
+	if err != nil {
+		return nil, err
+	}
+	return newSegmentReader(names)
+}
+
+// OpenRawHistory concatenates (mid, sid)'s on-disk .gz segments without
+// decompressing them. Concatenated gzip members are themselves a valid
+// gzip stream per RFC 1952, so a caller that just wants to hand compressed
+// bytes to an HTTP client (see HandleLogcatHistoryDownload) can skip
+// decompressing through OpenHistory only to compress the result again.
+func (self *LogcatStore) OpenRawHistory(mid, sid string) (io.ReadCloser, error) {
+	if err := self.flushStream(mid, sid); err != nil {
+		return nil, err
+	}
+	names, err := self.segments(mid, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(names))
+	readers := make([]io.Reader, 0, len(names))
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			for _, opened := range files {
+				opened.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	return &rawHistoryReader{Reader: io.MultiReader(readers...), files: files}, nil
+}
+
+// rawHistoryReader is OpenRawHistory's io.ReadCloser: io.MultiReader has no
+// Close of its own, so this just tracks the underlying files to close.
+type rawHistoryReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (self *rawHistoryReader) Close() error {
+	var err error
+	for _, f := range self.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Tail returns the last maxBytes (decompressed) of history for (mid, sid),
+// used to replay recent output to a websocket that joins a logcat session
+// late (see ConnServer.handleOverlordRequest's ConnectLogcatCmd case).
+func (self *LogcatStore) Tail(mid, sid string, maxBytes int) (string, error) {
+	rc, err := self.OpenHistory(mid, sid)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	// A ring buffer over the decompressed stream avoids holding the whole
+	// (potentially multi-segment) history in memory just to keep the tail.
+	ring := make([]byte, 0, maxBytes)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			ring = append(ring, buf[:n]...)
+			if len(ring) > maxBytes {
+				ring = ring[len(ring)-maxBytes:]
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(ring), nil
+}
+
+// segmentReader chains the gzip streams of multiple segment files into a
+// single io.ReadCloser, decompressing each in turn; the same "open file,
+// wrap in a streaming decompression Reader" shape diskv uses for its
+// Compression.Reader.
+type segmentReader struct {
+	names  []string
+	idx    int
+	file   *os.File
+	gz     *gzip.Reader
+	reader *bufio.Reader
+}
+
+func newSegmentReader(names []string) (*segmentReader, error) {
+	sr := &segmentReader{names: names}
+	if err := sr.openNext(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func (self *segmentReader) openNext() error {
+	if self.gz != nil {
+		self.gz.Close()
+		self.file.Close()
+		self.gz, self.file, self.reader = nil, nil, nil
+	}
+	if self.idx >= len(self.names) {
+		return io.EOF
+	}
+
+	f, err := os.Open(self.names[self.idx])
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	self.idx++
+	self.file = f
+	self.gz = gz
+	self.reader = bufio.NewReader(gz)
+	return nil
+}
+
+func (self *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if self.reader == nil {
+			return 0, io.EOF
+		}
+		n, err := self.reader.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+		// logcatStream.append closes out a gzip member on every flush (see
+		// flushLocked), but whatever has been written since the last flush
+		// point is still sitting in an open, footer-less gzip.Writer until
+		// the next one. gzip.Reader surfaces that as ErrUnexpectedEOF once
+		// it's drained everything closed out so far, which for the
+		// still-accumulating tail of a live segment just means "no more
+		// data yet", not corruption; treat it the same as io.EOF.
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if oerr := self.openNext(); oerr != nil {
+				self.reader = nil
+				return 0, io.EOF
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (self *segmentReader) Close() error {
+	if self.gz != nil {
+		self.gz.Close()
+		self.file.Close()
+	}
+	return nil
+}
+
+// evictLoop periodically drops the oldest segments of every session once
+// they exceed budgetSize or maxAge, since unlike the old in-memory ring
+// there's nothing else bounding disk usage.
+func (self *LogcatStore) evictLoop() {
+	ticker := time.NewTicker(LOGCAT_EVICT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			self.evictOnce()
+		case <-self.stopEvict:
+			return
+		}
+	}
+}
+
+func (self *LogcatStore) evictOnce() {
+	entries, err := os.ReadDir(self.baseDir)
+	if err != nil {
+		return
+	}
+	for _, mid := range entries {
+		if !mid.IsDir() {
+			continue
+		}
+		sidEntries, err := os.ReadDir(filepath.Join(self.baseDir, mid.Name()))
+		if err != nil {
+			continue
+		}
+		for _, sid := range sidEntries {
+			if sid.IsDir() {
+				self.evictSession(mid.Name(), sid.Name())
+			}
+		}
+	}
+}
+
+func (self *LogcatStore) evictSession(mid, sid string) {
+	names, err := self.segments(mid, sid)
+	if err != nil || len(names) == 0 {
+		return
+	}
+
+	self.mu.Lock()
+	stream := self.streams[logcatKey(mid, sid)]
+	self.mu.Unlock()
+	var livePath string
+	if stream != nil {
+		livePath = stream.currentPath()
+	}
+
+	var total int64
+	cutoff := time.Now().Add(-self.maxAge)
+	// Walk newest-first so we always keep the most recent segments within
+	// budget and age out everything older once either limit is hit.
+	for i := len(names) - 1; i >= 0; i-- {
+		info, err := os.Stat(names[i])
+		if err != nil {
+			continue
+		}
+		if names[i] == livePath {
+			// Never evict the segment a logcatStream still has open for
+			// writing, even if it's gone quiet long enough to look like the
+			// oldest-touched file or to blow the budget on its own:
+			// unlinking it out from under the open fd would make the
+			// session invisible to segments()/future eviction while
+			// silently dropping every byte written to it, before and after,
+			// until the fd is finally closed (rotate or connection
+			// teardown) with no error surfaced anywhere. Still count it
+			// against the budget so older segments age out in its place.
+			total += info.Size()
+			continue
+		}
+		if info.ModTime().Before(cutoff) || total+info.Size() > self.budgetSize {
+			if err := os.Remove(names[i]); err != nil {
+				log.Printf("logcat store: failed to evict %s: %s\n", names[i], err)
+			}
+			continue
+		}
+		total += info.Size()
+	}
+}
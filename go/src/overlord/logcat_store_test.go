@@ -0,0 +1,208 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestLogcatStoreTailReadsOpenSegment is a regression test for a bug where
+// Tail/OpenHistory returned an error for any session whose current segment
+// was only Flushed (not yet Closed/rotated), which is the common case for a
+// live session — see segmentReader.Read's ErrUnexpectedEOF handling.
+func TestLogcatStoreTailReadsOpenSegment(t *testing.T) {
+	store, err := NewLogcatStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewLogcatStore: %s", err)
+	}
+	defer store.Close()
+
+	mid, sid := "mid1", "sid1"
+	if err := store.Append(mid, sid, []byte("hello ")); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	if err := store.Append(mid, sid, []byte("world")); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+
+	tail, err := store.Tail(mid, sid, LOGCAT_TAIL_BYTES)
+	if err != nil {
+		t.Fatalf("Tail on a still-open segment returned an error: %s", err)
+	}
+	if tail != "hello world" {
+		t.Fatalf("got %q, want %q", tail, "hello world")
+	}
+
+	rc, err := store.OpenHistory(mid, sid)
+	if err != nil {
+		t.Fatalf("OpenHistory: %s", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("OpenHistory read on a still-open segment returned an error: %s", err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("got %q, want %q", data, "hello world")
+	}
+}
+
+// TestLogcatStoreTailAcrossClosedSegments exercises the multi-segment path,
+// where earlier segments have gone through rotate() (and so were properly
+// Closed, with a real gzip footer) while the last one is still open.
+func TestLogcatStoreTailAcrossClosedSegments(t *testing.T) {
+	store, err := NewLogcatStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewLogcatStore: %s", err)
+	}
+	defer store.Close()
+
+	mid, sid := "mid1", "sid1"
+	stream, err := store.getStream(mid, sid)
+	if err != nil {
+		t.Fatalf("getStream: %s", err)
+	}
+
+	if err := stream.append([]byte("segment-one ")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	if err := stream.rotate(); err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+	if err := stream.append([]byte("segment-two")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+
+	tail, err := store.Tail(mid, sid, LOGCAT_TAIL_BYTES)
+	if err != nil {
+		t.Fatalf("Tail across a closed and an open segment returned an error: %s", err)
+	}
+	if tail != "segment-one segment-two" {
+		t.Fatalf("got %q, want %q", tail, "segment-one segment-two")
+	}
+}
+
+// TestLogcatStoreOpenRawHistoryIsValidGzip checks that the raw .gz bytes
+// OpenRawHistory hands back for HandleLogcatHistoryDownload decompress
+// cleanly even though they span a closed segment and a still-live one that
+// was only flushed, not rotated: flushLocked must close out a complete
+// gzip member at every flush point, not just sync-flush one, or the live
+// segment's tail member would be left without a footer.
+func TestLogcatStoreOpenRawHistoryIsValidGzip(t *testing.T) {
+	store, err := NewLogcatStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewLogcatStore: %s", err)
+	}
+	defer store.Close()
+
+	mid, sid := "mid1", "sid1"
+	stream, err := store.getStream(mid, sid)
+	if err != nil {
+		t.Fatalf("getStream: %s", err)
+	}
+	if err := stream.append([]byte("segment-one ")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	if err := stream.rotate(); err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+	if err := stream.append([]byte("segment-two")); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+
+	rc, err := store.OpenRawHistory(mid, sid)
+	if err != nil {
+		t.Fatalf("OpenRawHistory: %s", err)
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading raw history: %s", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("raw history is not valid gzip: %s", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("decompressing raw history: %s", err)
+	}
+	if string(data) != "segment-one segment-two" {
+		t.Fatalf("got %q, want %q", data, "segment-one segment-two")
+	}
+}
+
+// TestLogcatStoreEvictionSkipsOpenLiveSegment is a regression test for a
+// bug where evictSession could unlink the segment file a logcatStream still
+// has open for writing — e.g. a long-idle session whose last write is older
+// than maxAge, or a tight budget — silently losing every byte written to it
+// from then on, since the open fd keeps writing to a now-unlinked inode
+// that segments()/future eviction can no longer see.
+func TestLogcatStoreEvictionSkipsOpenLiveSegment(t *testing.T) {
+	store, err := NewLogcatStore(t.TempDir(), 0, time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewLogcatStore: %s", err)
+	}
+	defer store.Close()
+
+	mid, sid := "mid1", "sid1"
+	if err := store.Append(mid, sid, []byte("hello")); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond) // age the live segment past maxAge
+
+	store.evictOnce()
+
+	names, err := store.segments(mid, sid)
+	if err != nil {
+		t.Fatalf("segments: %s", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("got %d segment files after eviction, want 1 (the still-open live segment)", len(names))
+	}
+
+	tail, err := store.Tail(mid, sid, LOGCAT_TAIL_BYTES)
+	if err != nil {
+		t.Fatalf("Tail after eviction: %s", err)
+	}
+	if tail != "hello" {
+		t.Fatalf("got %q, want %q", tail, "hello")
+	}
+}
+
+// TestLogcatStoreRejectsPathTraversal is a regression test for a bug where
+// a ghost registering with e.g. mid="../../../../tmp/evil" could make
+// getStream/segments read, write or evict files outside baseDir, since mid/
+// sid went straight into filepath.Join with no sanitization.
+func TestLogcatStoreRejectsPathTraversal(t *testing.T) {
+	store, err := NewLogcatStore(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewLogcatStore: %s", err)
+	}
+	defer store.Close()
+
+	evilPairs := [][2]string{
+		{"../../../../tmp/evil", "sid1"},
+		{"mid1", "../../../../tmp/evil"},
+		{"..", "sid1"},
+		{"mid/1", "sid1"},
+		{"mid1", "sid\\1"},
+	}
+
+	for _, pair := range evilPairs {
+		mid, sid := pair[0], pair[1]
+		if err := store.Append(mid, sid, []byte("x")); err == nil {
+			t.Fatalf("Append(%q, %q) should have been rejected as unsafe", mid, sid)
+		}
+		if _, err := store.OpenHistory(mid, sid); err == nil {
+			t.Fatalf("OpenHistory(%q, %q) should have been rejected as unsafe", mid, sid)
+		}
+	}
+}
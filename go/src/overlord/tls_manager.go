@@ -0,0 +1,436 @@
+// Copyright 2015 The Chromium OS Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package overlord
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	CA_CERT_FILENAME     = "ca.pem"
+	CA_KEY_FILENAME      = "ca-key.pem"
+	SERVER_CERT_FILENAME = "cert.pem"
+	SERVER_KEY_FILENAME  = "key.pem"
+
+	CLIENT_CERT_VALIDITY  = 24 * time.Hour
+	SERVER_CERT_VALIDITY  = 5 * 365 * 24 * time.Hour
+	BOOTSTRAP_TOKEN_BYTES = 32
+	BOOTSTRAP_TOKEN_TTL   = 15 * time.Minute
+)
+
+// CertManager owns the CA and server TLS material Overlord uses for mutual
+// TLS between ghosts and ConnServer. Certs and keys are persisted under
+// stateDir so they survive restarts; NewCertManager only invokes
+// GenerateAndSaveCA/GenerateAndSaveServerCert the first time Overlord runs
+// against a given state dir (RotateServerKey and ImportCA re-run
+// GenerateAndSaveServerCert).
+type CertManager struct {
+	stateDir string
+
+	mu         sync.Mutex
+	caCert     *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	serverCert tls.Certificate
+
+	tokens map[string]bootstrapToken // hashToken(token) -> mid and expiry it can be redeemed for
+}
+
+type bootstrapToken struct {
+	mid     string
+	expires time.Time
+}
+
+// NewCertManager loads an existing CA/server cert from stateDir, generating
+// and saving both if this is the first run.
+func NewCertManager(stateDir string) (*CertManager, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+
+	cm := &CertManager{
+		stateDir: stateDir,
+		tokens:   make(map[string]bootstrapToken),
+	}
+
+	if _, err := os.Stat(filepath.Join(stateDir, CA_CERT_FILENAME)); os.IsNotExist(err) {
+		if err := cm.GenerateAndSaveCA(); err != nil {
+			return nil, err
+		}
+	} else if err := cm.loadCA(); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(stateDir, SERVER_CERT_FILENAME)); os.IsNotExist(err) {
+		if err := cm.GenerateAndSaveServerCert(); err != nil {
+			return nil, err
+		}
+	} else if err := cm.loadServerCert(); err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// GenerateAndSaveCA creates a self-signed CA and writes it to
+// <stateDir>/ca.pem and <stateDir>/ca-key.pem with 0600 permissions on the
+// key, matching the convention used for the rest of Overlord's on-disk state.
+func (self *CertManager) GenerateAndSaveCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Overlord Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(self.stateDir, CA_CERT_FILENAME), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(self.stateDir, CA_KEY_FILENAME), "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	self.caCert = cert
+	self.caKey = key
+	self.mu.Unlock()
+	return nil
+}
+
+// GenerateAndSaveServerCert mints a server cert signed by the CA and writes
+// it to <stateDir>/cert.pem and <stateDir>/key.pem, the same filenames the
+// HTTP server already expects when TLS is enabled.
+func (self *CertManager) GenerateAndSaveServerCert() error {
+	self.mu.Lock()
+	caCert, caKey := self.caCert, self.caKey
+	self.mu.Unlock()
+	if caCert == nil || caKey == nil {
+		return errors.New("GenerateAndSaveServerCert: no CA loaded")
+	}
+
+	certDer, keyDer, err := issueCert(caCert, caKey, pkix.Name{CommonName: "overlord-server"}, nil, SERVER_CERT_VALIDITY, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return err
+	}
+
+	// The leaf alone doesn't chain to anything: PinnedTLSConfig
+	// (ghost_pinning.go) pins against the CA's public key by scanning the
+	// chain a ghost actually receives over the wire, so the CA cert has to
+	// ride along in the same file tls.LoadX509KeyPair reads back as
+	// serverCert.Certificate, or every pinned ghost connection fails with
+	// "bad certificate".
+	if err := writeCertChainPEM(filepath.Join(self.stateDir, SERVER_CERT_FILENAME), 0644, certDer, caCert.Raw); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(self.stateDir, SERVER_KEY_FILENAME), "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+
+	return self.loadServerCert()
+}
+
+// RotateServerKey re-issues the server cert/key pair under the same CA,
+// for operators who want to invalidate a possibly-leaked server key without
+// tearing down the whole CA (and thus every client cert).
+func (self *CertManager) RotateServerKey() error {
+	return self.GenerateAndSaveServerCert()
+}
+
+// ImportCA replaces the managed CA with an externally supplied one, e.g. an
+// organization's existing PKI, so Overlord stops minting its own.
+func (self *CertManager) ImportCA(certPath, keyPath string) error {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(self.stateDir, CA_CERT_FILENAME), certPEM, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(self.stateDir, CA_KEY_FILENAME), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := self.loadCA(); err != nil {
+		return err
+	}
+	return self.GenerateAndSaveServerCert()
+}
+
+func (self *CertManager) loadCA() error {
+	certPEM, err := os.ReadFile(filepath.Join(self.stateDir, CA_CERT_FILENAME))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(self.stateDir, CA_KEY_FILENAME))
+	if err != nil {
+		return err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	self.caCert = cert
+	self.caKey = key
+	self.mu.Unlock()
+	return nil
+}
+
+func (self *CertManager) loadServerCert() error {
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(self.stateDir, SERVER_CERT_FILENAME),
+		filepath.Join(self.stateDir, SERVER_KEY_FILENAME))
+	if err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	self.serverCert = cert
+	self.mu.Unlock()
+	return nil
+}
+
+// ServerTLSConfig returns a tls.Config for ConnServer/the HTTP server:
+// present the server cert, and require+verify a client cert signed by our
+// CA. Mid-to-cert binding is enforced afterwards, in
+// ConnServer.handleRegisterRequest, once we know which Mid the ghost claims.
+func (self *CertManager) ServerTLSConfig() *tls.Config {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(self.caCert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{self.serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+}
+
+// WrapListener wraps l so every Accept returns an mTLS-terminated *tls.Conn
+// configured per ServerTLSConfig, the integration point `overlord run`'s
+// accept loop calls into once it binds l.
+func (self *CertManager) WrapListener(l net.Listener) net.Listener {
+	return tls.NewListener(l, self.ServerTLSConfig())
+}
+
+// IssueClientCert mints a short-lived client cert bound to mid (as both CN
+// and a DNS SAN, so handleRegisterRequest can check either).
+func (self *CertManager) IssueClientCert(mid string) (certPEM, keyPEM []byte, err error) {
+	self.mu.Lock()
+	caCert, caKey := self.caCert, self.caKey
+	self.mu.Unlock()
+	if caCert == nil || caKey == nil {
+		return nil, nil, errors.New("IssueClientCert: no CA loaded")
+	}
+
+	certDer, keyDer, err := issueCert(caCert, caKey, pkix.Name{CommonName: mid}, []string{mid}, CLIENT_CERT_VALIDITY, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), nil
+}
+
+// IssueBootstrapToken returns a one-time token a new ghost can redeem (via
+// RedeemBootstrapToken) for a client cert bound to mid, so an operator can
+// hand a brand new device a single opaque string instead of a private key.
+func (self *CertManager) IssueBootstrapToken(mid string) (string, error) {
+	buf := make([]byte, BOOTSTRAP_TOKEN_BYTES)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	self.mu.Lock()
+	self.tokens[hashToken(token)] = bootstrapToken{mid: mid, expires: time.Now().Add(BOOTSTRAP_TOKEN_TTL)}
+	self.mu.Unlock()
+	return token, nil
+}
+
+// RedeemBootstrapToken consumes token (it cannot be redeemed twice) and
+// returns a freshly issued client cert/key for the Mid it was created for.
+func (self *CertManager) RedeemBootstrapToken(token string) (certPEM, keyPEM []byte, err error) {
+	h := hashToken(token)
+
+	self.mu.Lock()
+	bt, ok := self.tokens[h]
+	if ok {
+		delete(self.tokens, h)
+	}
+	self.mu.Unlock()
+
+	if !ok {
+		return nil, nil, errors.New("RedeemBootstrapToken: unknown or already-redeemed token")
+	}
+	if time.Now().After(bt.expires) {
+		return nil, nil, errors.New("RedeemBootstrapToken: token expired")
+	}
+
+	return self.IssueClientCert(bt.mid)
+}
+
+// caPublicKeyDER returns the DER-encoded SubjectPublicKeyInfo of the CA's
+// public key, used by GenerateBundle to embed a pinnable key in a
+// ServerEntry without shipping the whole CA certificate.
+func (self *CertManager) caPublicKeyDER() []byte {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	der, err := x509.MarshalPKIXPublicKey(&self.caKey.PublicKey)
+	if err != nil {
+		// self.caKey is always an ECDSA key we generated or loaded ourselves;
+		// MarshalPKIXPublicKey cannot fail against that shape.
+		panic(err)
+	}
+	return der
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func issueCert(caCert *x509.Certificate, caKey *ecdsa.PrivateKey, subject pkix.Name, dnsNames []string, validity time.Duration, extKeyUsage x509.ExtKeyUsage) (certDer, keyDer []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{extKeyUsage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return der, kder, nil
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+}
+
+// writeCertChainPEM writes each of ders as a sequential CERTIFICATE PEM
+// block to path, leaf first, the layout tls.LoadX509KeyPair expects to
+// rebuild a multi-cert chain from a single file.
+func writeCertChainPEM(path string, perm os.FileMode, ders ...[]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, der := range ders {
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyMidMatchesCert checks that mid (as claimed in a register request)
+// matches the CN or a DNS SAN of the client cert presented over conn, if
+// conn is a *tls.Conn. Non-TLS connections (mTLS disabled) are left alone.
+func verifyMidMatchesCert(conn net.Conn, mid string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("verifyMidMatchesCert: no client certificate presented")
+	}
+
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName == mid {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == mid {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("verifyMidMatchesCert: client cert (CN=%s) does not match claimed mid %s", cert.Subject.CommonName, mid)
+}